@@ -0,0 +1,163 @@
+// Package carrier 在WebsocketServer之上提供TCP隧道能力，
+// 让operator可以把SSH、数据库、RPC等非WS协议透过同一个TLS端口转发出去。
+package carrier
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/duanhf2012/origin/network"
+	"github.com/duanhf2012/origin/service"
+	"github.com/duanhf2012/origin/sysmodule"
+
+	"github.com/gorilla/websocket"
+)
+
+// TunnelReciver 注册到WebsocketServer的pattern上后，每个连接都会拨号到Backend，
+// 并把WS二进制帧与TCP字节流做双向转发
+type TunnelReciver struct {
+	network.BaseMessageReciver
+
+	Backend string
+
+	locker     sync.Mutex
+	mapBackend map[uint64]net.Conn
+}
+
+// NewTunnelReciver 创建一个转发到backend(host:port)的隧道接收器
+func NewTunnelReciver(backend string) *TunnelReciver {
+	return &TunnelReciver{
+		Backend:    backend,
+		mapBackend: make(map[uint64]net.Conn),
+	}
+}
+
+func (slf *TunnelReciver) OnConnected(clientid uint64) {
+	backendConn, err := net.Dial("tcp", slf.Backend)
+	if err != nil {
+		service.GetLogger().Printf(sysmodule.LEVER_INFO, "carrier dial backend %s error:%v\n", slf.Backend, err)
+		slf.WsServer.Disconnect(clientid)
+		return
+	}
+
+	slf.locker.Lock()
+	slf.mapBackend[clientid] = backendConn
+	slf.locker.Unlock()
+
+	go slf.pumpBackendToClient(clientid, backendConn)
+}
+
+func (slf *TunnelReciver) OnDisconnect(clientid uint64, err error) {
+	slf.locker.Lock()
+	backendConn, ok := slf.mapBackend[clientid]
+	delete(slf.mapBackend, clientid)
+	slf.locker.Unlock()
+
+	if ok {
+		backendConn.Close()
+	}
+}
+
+func (slf *TunnelReciver) OnRecvMsg(clientid uint64, msgtype int, data []byte) {
+	slf.locker.Lock()
+	backendConn, ok := slf.mapBackend[clientid]
+	slf.locker.Unlock()
+
+	if ok == false {
+		return
+	}
+
+	if _, err := backendConn.Write(data); err != nil {
+		slf.WsServer.Disconnect(clientid)
+	}
+}
+
+func (slf *TunnelReciver) pumpBackendToClient(clientid uint64, backendConn net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := backendConn.Read(buf)
+		if n > 0 {
+			if slf.WsServer.SendMsg(clientid, websocket.BinaryMessage, append([]byte(nil), buf[:n]...)) == false {
+				break
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				service.GetLogger().Printf(sysmodule.LEVER_INFO, "carrier read backend error:%v\n", err)
+			}
+			slf.WsServer.Disconnect(clientid)
+			break
+		}
+	}
+}
+
+// ListenAndServe 在本地监听localAddr，把每一个接受到的TCP连接透过remoteWsUrl隧道出去，
+// 用于edge场景里只开放443端口时，让本地进程依然能像直连TCP一样使用远端服务
+func ListenAndServe(localAddr string, remoteWsUrl string) error {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			service.GetLogger().Printf(sysmodule.LEVER_INFO, "carrier accept error:%v\n", err)
+			continue
+		}
+
+		go serveConn(conn, remoteWsUrl)
+	}
+}
+
+func serveConn(conn net.Conn, remoteWsUrl string) {
+	defer conn.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(remoteWsUrl, nil)
+	if err != nil {
+		service.GetLogger().Printf(sysmodule.LEVER_INFO, "carrier dial %s error:%v\n", remoteWsUrl, err)
+		return
+	}
+	defer wsConn.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		//本地连接或WS任一方向结束时都要把两端一起关掉，否则另一方向会一直阻塞在Read/ReadMessage上
+		defer conn.Close()
+		defer wsConn.Close()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		msgtype, message, err := wsConn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if msgtype != websocket.BinaryMessage {
+			continue
+		}
+		if _, err := conn.Write(message); err != nil {
+			break
+		}
+	}
+
+	conn.Close()
+	wsConn.Close()
+
+	<-done
+}
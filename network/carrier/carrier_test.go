@@ -0,0 +1,162 @@
+package carrier
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/duanhf2012/origin/network"
+)
+
+// freePort 找一个当前空闲的TCP端口，WebsocketServer.Init只接受端口号，没有Addr()可供回读
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("find free port error: %v", err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// TestTunnelRoundTrip 搭起 本地TCP客户端 -> ListenAndServe -> WebsocketServer+TunnelReciver -> 后端TCP
+// 的完整链路，验证双向转发的字节能正确到达对端
+func TestTunnelRoundTrip(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend error: %v", err)
+	}
+	defer backendLn.Close()
+
+	backendAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		backendAccepted <- conn
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				conn.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	port := freePort(t)
+	srv := &network.WebsocketServer{}
+	srv.Init(port)
+	srv.SetupReciver("/tunnel", NewTunnelReciver(backendLn.Addr().String()), false)
+	srv.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	localLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen local error: %v", err)
+	}
+	localAddr := localLn.Addr().String()
+	localLn.Close()
+
+	wsUrl := fmt.Sprintf("ws://127.0.0.1:%d/tunnel", port)
+	go ListenAndServe(localAddr, wsUrl)
+	time.Sleep(100 * time.Millisecond)
+
+	localConn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("dial local error: %v", err)
+	}
+	defer localConn.Close()
+
+	if _, err := localConn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	select {
+	case <-backendAccepted:
+	case <-time.After(time.Second):
+		t.Fatal("backend never accepted a connection")
+	}
+
+	localConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := localConn.Read(buf)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("expected echoed %q, got %q", "hello", buf[:n])
+	}
+}
+
+// TestTunnelClosesBothEndsWhenLocalSideGoesAway 确认本地连接关闭后，隧道另一端(后端连接)
+// 也会被及时关闭，而不是一直阻塞
+func TestTunnelClosesBothEndsWhenLocalSideGoesAway(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend error: %v", err)
+	}
+	defer backendLn.Close()
+
+	backendAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		backendAccepted <- conn
+	}()
+
+	port := freePort(t)
+	srv := &network.WebsocketServer{}
+	srv.Init(port)
+	srv.SetupReciver("/tunnel", NewTunnelReciver(backendLn.Addr().String()), false)
+	srv.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	localLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen local error: %v", err)
+	}
+	localAddr := localLn.Addr().String()
+	localLn.Close()
+
+	wsUrl := fmt.Sprintf("ws://127.0.0.1:%d/tunnel", port)
+	go ListenAndServe(localAddr, wsUrl)
+	time.Sleep(100 * time.Millisecond)
+
+	localConn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("dial local error: %v", err)
+	}
+	if _, err := localConn.Write([]byte("hi")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	var backendConn net.Conn
+	select {
+	case backendConn = <-backendAccepted:
+	case <-time.After(time.Second):
+		t.Fatal("backend never accepted a connection")
+	}
+
+	//先把已经转发过来的"hi"读掉，避免它跟随后的EOF混在一起
+	buf := make([]byte, 16)
+	backendConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := backendConn.Read(buf); err != nil {
+		t.Fatalf("read forwarded bytes error: %v", err)
+	}
+
+	localConn.Close()
+
+	backendConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = backendConn.Read(buf)
+	if err == nil {
+		t.Fatal("expected backend connection to be closed after the local peer disconnected")
+	}
+}
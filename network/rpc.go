@@ -0,0 +1,298 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duanhf2012/origin/service"
+	"github.com/duanhf2012/origin/sysmodule"
+
+	"github.com/gorilla/websocket"
+)
+
+// rpcMessage 是RPCReceiver在WS二进制帧上承载的信封，Payload按Codec编解码，信封本身固定用JSON承载
+type rpcMessage struct {
+	ID      uint64 `json:"id,omitempty"`
+	Method  string `json:"method,omitempty"`
+	Notify  bool   `json:"notify,omitempty"`
+	Reply   bool   `json:"reply,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// rpcHandler 保存一个已注册方法的反射信息，reqType固定要求为指针类型
+type rpcHandler struct {
+	fn      reflect.Value
+	reqType reflect.Type
+}
+
+type pendingCall struct {
+	clientid uint64
+	resp     interface{}
+	done     chan error
+}
+
+// defaultMaxConcurrentRequests 是dispatchRequest并发协程数的默认上限，
+// 防止单个连接狂发消息时把服务端goroutine数打爆
+const defaultMaxConcurrentRequests = 256
+
+// RPCReceiver 在BaseMessageReciver之上提供net/rpc风格的请求/响应通道，
+// 并支持服务端主动推送(Notify)，让service包里的模块不用再手写帧处理
+type RPCReceiver struct {
+	BaseMessageReciver
+
+	Codec Codec
+
+	seq      uint64
+	locker   sync.Mutex
+	handlers map[string]*rpcHandler
+	pending  map[uint64]*pendingCall
+	sem      chan struct{}
+}
+
+// NewRPCReceiver 创建一个使用codec编解码负载的RPC接收器，codec为nil时使用JsonCodec
+func NewRPCReceiver(codec Codec) *RPCReceiver {
+	if codec == nil {
+		codec = JsonCodec{}
+	}
+
+	return &RPCReceiver{
+		Codec:    codec,
+		handlers: make(map[string]*rpcHandler),
+		pending:  make(map[uint64]*pendingCall),
+		sem:      make(chan struct{}, defaultMaxConcurrentRequests),
+	}
+}
+
+// SetMaxConcurrentRequests 设置同时处理中的请求数上限，超出的请求会直接收到繁忙错误(Notify则只记日志)
+// 而不是无限制地起goroutine
+func (slf *RPCReceiver) SetMaxConcurrentRequests(n int) {
+	if n <= 0 {
+		return
+	}
+	slf.sem = make(chan struct{}, n)
+}
+
+// RegisterHandler 注册一个method的处理函数，签名必须是func(clientid uint64, req *ReqType) (*RespType, error)
+func (slf *RPCReceiver) RegisterHandler(method string, handlerFunc interface{}) error {
+	fnVal := reflect.ValueOf(handlerFunc)
+	fnType := fnVal.Type()
+
+	var errType = reflect.TypeOf((*error)(nil)).Elem()
+	var clientidType = reflect.TypeOf(uint64(0))
+	if fnType.Kind() != reflect.Func || fnType.NumIn() != 2 || fnType.NumOut() != 2 ||
+		fnType.In(0) != clientidType || fnType.In(1).Kind() != reflect.Ptr ||
+		fnType.Out(1) != errType {
+		return fmt.Errorf("network: handler for %q must be func(clientid uint64, req *ReqType) (*RespType, error)", method)
+	}
+
+	slf.locker.Lock()
+	slf.handlers[method] = &rpcHandler{fn: fnVal, reqType: fnType.In(1)}
+	slf.locker.Unlock()
+
+	return nil
+}
+
+// Call 向clientid发起一次同步RPC调用并等待解码后的回复，timeout<=0表示不设置超时
+func (slf *RPCReceiver) Call(clientid uint64, method string, req interface{}, resp interface{}, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return slf.CallContext(ctx, clientid, method, req, resp)
+}
+
+// CallContext 与Call相同，但可以通过ctx提前取消调用
+func (slf *RPCReceiver) CallContext(ctx context.Context, clientid uint64, method string, req interface{}, resp interface{}) error {
+	payload, err := slf.Codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	id := atomic.AddUint64(&slf.seq, 1)
+	call := &pendingCall{clientid: clientid, resp: resp, done: make(chan error, 1)}
+
+	slf.locker.Lock()
+	slf.pending[id] = call
+	slf.locker.Unlock()
+
+	defer func() {
+		slf.locker.Lock()
+		delete(slf.pending, id)
+		slf.locker.Unlock()
+	}()
+
+	if err := slf.send(clientid, rpcMessage{ID: id, Method: method, Payload: payload}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-call.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notify 向clientid推送一条无需回复的消息，用于服务端主动push
+func (slf *RPCReceiver) Notify(clientid uint64, method string, v interface{}) error {
+	payload, err := slf.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return slf.send(clientid, rpcMessage{Method: method, Notify: true, Payload: payload})
+}
+
+func (slf *RPCReceiver) send(clientid uint64, msg rpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if slf.WsServer.SendMsg(clientid, websocket.BinaryMessage, data) == false {
+		return errors.New("network: client is not connected")
+	}
+
+	return nil
+}
+
+// OnDisconnect 让客户端断线时不再被等待的Call无限期挂起
+func (slf *RPCReceiver) OnDisconnect(clientid uint64, err error) {
+	slf.locker.Lock()
+	for id, call := range slf.pending {
+		if call.clientid != clientid {
+			continue
+		}
+		delete(slf.pending, id)
+		call.done <- fmt.Errorf("network: client %d disconnected: %v", clientid, err)
+	}
+	slf.locker.Unlock()
+}
+
+// OnRecvMsg 解出RPC信封，分派给已注册的方法处理函数或等待中的Call
+func (slf *RPCReceiver) OnRecvMsg(clientid uint64, msgtype int, data []byte) {
+	var msg rpcMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		service.GetLogger().Printf(sysmodule.LEVER_INFO, "rpc decode envelope error:%v\n", err)
+		return
+	}
+
+	if msg.Reply {
+		slf.dispatchReply(clientid, msg)
+		return
+	}
+
+	//请求处理可能耗时，放到独立协程里跑，避免阻塞读循环导致的ping/pong无法及时处理；
+	//用有缓冲的sem控制同时在跑的协程数，避免单个连接发大量消息时goroutine数量失控
+	select {
+	case slf.sem <- struct{}{}:
+		go func() {
+			defer func() { <-slf.sem }()
+			slf.dispatchRequest(clientid, msg)
+		}()
+	default:
+		if msg.Notify == false {
+			slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: "network: server busy, too many concurrent requests"})
+		} else {
+			service.GetLogger().Printf(sysmodule.LEVER_INFO, "rpc notify %q dropped: too many concurrent requests\n", msg.Method)
+		}
+	}
+}
+
+func (slf *RPCReceiver) dispatchReply(clientid uint64, msg rpcMessage) {
+	slf.locker.Lock()
+	call, ok := slf.pending[msg.ID]
+	if ok {
+		if call.clientid != clientid {
+			//id由全局自增计数器分配，不能信任来自其他连接的回复，防止串话/伪造
+			slf.locker.Unlock()
+			service.GetLogger().Printf(sysmodule.LEVER_INFO, "rpc reply id %d from client %d does not belong to it, dropped\n", msg.ID, clientid)
+			return
+		}
+		delete(slf.pending, msg.ID)
+	}
+	slf.locker.Unlock()
+
+	if ok == false {
+		return
+	}
+
+	if msg.Error != "" {
+		call.done <- errors.New(msg.Error)
+		return
+	}
+
+	call.done <- slf.Codec.Unmarshal(msg.Payload, call.resp)
+}
+
+func (slf *RPCReceiver) dispatchRequest(clientid uint64, msg rpcMessage) {
+	slf.locker.Lock()
+	handler, ok := slf.handlers[msg.Method]
+	slf.locker.Unlock()
+
+	if ok == false {
+		if msg.Notify == false {
+			slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: fmt.Sprintf("network: method %q not registered", msg.Method)})
+		}
+		return
+	}
+
+	reqPtr := reflect.New(handler.reqType.Elem())
+	if err := slf.Codec.Unmarshal(msg.Payload, reqPtr.Interface()); err != nil {
+		if msg.Notify == false {
+			slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: err.Error()})
+		}
+		return
+	}
+
+	results, panicErr := slf.callHandler(handler, clientid, reqPtr)
+	if panicErr != nil {
+		service.GetLogger().Printf(sysmodule.LEVER_INFO, "rpc handler %q panic:%v\n", msg.Method, panicErr)
+		if msg.Notify == false {
+			slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: panicErr.Error()})
+		}
+		return
+	}
+
+	if msg.Notify {
+		if errVal, ok := results[1].Interface().(error); ok && errVal != nil {
+			service.GetLogger().Printf(sysmodule.LEVER_INFO, "rpc notify handler %q error:%v\n", msg.Method, errVal)
+		}
+		return
+	}
+
+	if errVal, ok := results[1].Interface().(error); ok && errVal != nil {
+		slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: errVal.Error()})
+		return
+	}
+
+	payload, err := slf.Codec.Marshal(results[0].Interface())
+	if err != nil {
+		slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Error: err.Error()})
+		return
+	}
+
+	slf.send(clientid, rpcMessage{ID: msg.ID, Reply: true, Payload: payload})
+}
+
+// callHandler 执行已注册的处理函数，捕获其中的panic，避免单个请求拖垮整条连接
+func (slf *RPCReceiver) callHandler(handler *rpcHandler, clientid uint64, reqPtr reflect.Value) (results []reflect.Value, panicErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr = fmt.Errorf("network: %v", r)
+		}
+	}()
+
+	results = handler.fn.Call([]reflect.Value{reflect.ValueOf(clientid), reqPtr})
+	return results, nil
+}
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoReq struct {
+	Msg string `json:"msg"`
+}
+
+type echoResp struct {
+	Msg string `json:"msg"`
+}
+
+// TestRPCCallRoundTrip 验证一次完整的Call: 客户端发起请求，服务端处理函数返回结果，
+// 客户端的Call能解出正确的响应
+func TestRPCCallRoundTrip(t *testing.T) {
+	serverRPC := NewRPCReceiver(nil)
+	if err := serverRPC.RegisterHandler("Echo", func(clientid uint64, req *echoReq) (*echoResp, error) {
+		return &echoResp{Msg: req.Msg}, nil
+	}); err != nil {
+		t.Fatalf("RegisterHandler error: %v", err)
+	}
+
+	srv := &WebsocketServer{}
+	srv.Init(0)
+	srv.SetupReciver("/rpc", serverRPC, false)
+
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverRPC.OnHandleHttp(w, r)
+	}))
+	defer httpSrv.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+
+	clientRPC := NewRPCReceiver(nil)
+	client := NewWebsocketClient(wsUrl, clientRPC)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer client.Close()
+
+	var resp echoResp
+	if err := clientRPC.Call(0, "Echo", &echoReq{Msg: "hi"}, &resp, 2*time.Second); err != nil {
+		t.Fatalf("Call error: %v", err)
+	}
+	if resp.Msg != "hi" {
+		t.Fatalf("expected echo %q, got %q", "hi", resp.Msg)
+	}
+}
+
+// TestRPCDispatchReplyRejectsForeignClient 确认一个来自其他clientid的伪造回复不会解掉
+// 不属于它的pendingCall，而同一个clientid的真实回复仍能正常解出
+func TestRPCDispatchReplyRejectsForeignClient(t *testing.T) {
+	rpc := NewRPCReceiver(nil)
+
+	var resp echoResp
+	call := &pendingCall{clientid: 1, resp: &resp, done: make(chan error, 1)}
+	rpc.pending[42] = call
+
+	rpc.dispatchReply(2, rpcMessage{ID: 42, Reply: true, Payload: []byte(`{"msg":"forged"}`)})
+
+	select {
+	case <-call.done:
+		t.Fatal("forged reply from a different client should not resolve the pending call")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rpc.locker.Lock()
+	_, stillPending := rpc.pending[42]
+	rpc.locker.Unlock()
+	if stillPending == false {
+		t.Fatal("pending call should remain registered after a rejected forged reply")
+	}
+
+	rpc.dispatchReply(1, rpcMessage{ID: 42, Reply: true, Payload: []byte(`{"msg":"real"}`)})
+
+	select {
+	case err := <-call.done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("legitimate reply did not resolve the pending call")
+	}
+	if resp.Msg != "real" {
+		t.Fatalf("expected %q, got %q", "real", resp.Msg)
+	}
+}
+
+// TestRPCConcurrencyCapRejectsOverflow 确认并发请求数超过上限时直接收到繁忙错误，
+// 而不是无限制地起goroutine
+func TestRPCConcurrencyCapRejectsOverflow(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+
+	serverRPC := NewRPCReceiver(nil)
+	serverRPC.SetMaxConcurrentRequests(1)
+	if err := serverRPC.RegisterHandler("Block", func(clientid uint64, req *echoReq) (*echoResp, error) {
+		entered <- struct{}{}
+		<-release
+		return &echoResp{Msg: req.Msg}, nil
+	}); err != nil {
+		t.Fatalf("RegisterHandler error: %v", err)
+	}
+
+	srv := &WebsocketServer{}
+	srv.Init(0)
+	srv.SetupReciver("/rpc", serverRPC, false)
+
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverRPC.OnHandleHttp(w, r)
+	}))
+	defer httpSrv.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+
+	clientRPC := NewRPCReceiver(nil)
+	client := NewWebsocketClient(wsUrl, clientRPC)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer client.Close()
+
+	go clientRPC.Call(0, "Block", &echoReq{Msg: "first"}, &echoResp{}, 2*time.Second)
+
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("handler for the first call never started")
+	}
+
+	var resp echoResp
+	err := clientRPC.Call(0, "Block", &echoReq{Msg: "second"}, &resp, 2*time.Second)
+	close(release)
+
+	if err == nil {
+		t.Fatal("expected the second concurrent call to be rejected as busy")
+	}
+}
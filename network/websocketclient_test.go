@@ -0,0 +1,70 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type recordingClientReciver struct {
+	BaseMessageReciver
+
+	connected chan struct{}
+	recvMsg   chan []byte
+}
+
+func (slf *recordingClientReciver) OnConnected(clientid uint64) {
+	close(slf.connected)
+}
+
+func (slf *recordingClientReciver) OnRecvMsg(clientid uint64, msgtype int, data []byte) {
+	slf.recvMsg <- data
+}
+
+// TestWebsocketClientOnConnectedFiresOnInitialDial 确认首次Connect成功后也会像断线重连一样触发OnConnected，
+// 并验证客户端能正常收发消息
+func TestWebsocketClientOnConnectedFiresOnInitialDial(t *testing.T) {
+	srv := &WebsocketServer{}
+	srv.Init(0)
+	srv.SetupReciver("/ws", &echoReciver{}, false)
+
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.reciver["/ws"].messageReciver.OnHandleHttp(w, r)
+	}))
+	defer httpSrv.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+
+	clientReciver := &recordingClientReciver{
+		connected: make(chan struct{}),
+		recvMsg:   make(chan []byte, 1),
+	}
+	client := NewWebsocketClient(wsUrl, clientReciver)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-clientReciver.connected:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnected was not called after the initial dial")
+	}
+
+	if client.SendMsg(0, websocket.TextMessage, []byte("hello")) == false {
+		t.Fatal("SendMsg returned false")
+	}
+
+	select {
+	case msg := <-clientReciver.recvMsg:
+		if string(msg) != "hello" {
+			t.Fatalf("expected echoed %q, got %q", "hello", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive echoed message back")
+	}
+}
@@ -1,8 +1,10 @@
 package network
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
@@ -25,7 +27,7 @@ type IWebsocketServer interface {
 }
 
 type IMessageReceiver interface {
-	initReciver(messageReciver IMessageReceiver, websocketServer IWebsocketServer)
+	initReciver(messageReciver IMessageReceiver, websocketServer IWebsocketServer, reciver *Reciver)
 
 	OnConnected(clientid uint64)
 	OnDisconnect(clientid uint64, err error)
@@ -36,17 +38,34 @@ type IMessageReceiver interface {
 type Reciver struct {
 	messageReciver     IMessageReceiver
 	bEnableCompression bool
+	upgrader           websocket.Upgrader
+	compressionLevel   *int
+}
+
+// UpgraderOptions 用于在SetupReciver之后通过SetUpgraderOptions定制websocket.Upgrader的各项参数
+type UpgraderOptions struct {
+	ReadBufferSize   int
+	WriteBufferSize  int
+	HandshakeTimeout time.Duration
+	CheckOrigin      func(r *http.Request) bool
+	Subprotocols     []string
+
+	//CompressionLevel为nil时表示不覆盖默认压缩级别；flate.NoCompression(0)是合法取值，
+	//不能用零值代表"未设置"，因此用指针区分两者
+	CompressionLevel *int
 }
 
 type BaseMessageReciver struct {
 	messageReciver IMessageReceiver
 	WsServer       IWebsocketServer
+	reciver        *Reciver
 }
 
 type WSClient struct {
 	clientid  uint64
 	conn      *websocket.Conn
 	bwritemsg chan WSMessage
+	server    *WebsocketServer
 }
 
 type WSMessage struct {
@@ -63,25 +82,45 @@ type WebsocketServer struct {
 	port uint16
 
 	httpserver *http.Server
-	reciver    map[string]Reciver
+	reciver    map[string]*Reciver
 
 	certfile string
 	keyfile  string
 	iswss    bool
+
+	wg            sync.WaitGroup
+	closeDeadline time.Duration
+
+	WriteWait      time.Duration
+	PongWait       time.Duration
+	PingPeriod     time.Duration
+	MaxMessageSize int64
 }
 
 func (slf *WebsocketServer) Init(port uint16) {
 
 	slf.port = port
 	slf.mapClient = make(map[uint64]*WSClient)
+	slf.closeDeadline = 5 * time.Second
+
+	slf.WriteWait = 10 * time.Second
+	slf.PongWait = 60 * time.Second
+	slf.PingPeriod = (slf.PongWait * 9) / 10
+	slf.MaxMessageSize = 0
+}
+
+// SetCloseDeadline 设置Stop时下发关闭帧的等待时长
+func (slf *WebsocketServer) SetCloseDeadline(d time.Duration) {
+	slf.closeDeadline = d
 }
 
 func (slf *WebsocketServer) CreateClient(conn *websocket.Conn) *WSClient {
 	slf.locker.Lock()
 	slf.maxClientid++
 	clientid := slf.maxClientid
-	pclient := &WSClient{clientid, conn, make(chan WSMessage, 1024)}
+	pclient := &WSClient{clientid, conn, make(chan WSMessage, 1024), slf}
 	slf.mapClient[pclient.clientid] = pclient
+	slf.wg.Add(2)
 	slf.locker.Unlock()
 
 	return pclient
@@ -90,19 +129,73 @@ func (slf *WebsocketServer) CreateClient(conn *websocket.Conn) *WSClient {
 func (slf *WebsocketServer) ReleaseClient(pclient *WSClient) {
 	pclient.conn.Close()
 	slf.locker.Lock()
-	delete(slf.mapClient, pclient.clientid)
+	_, ok := slf.mapClient[pclient.clientid]
+	if ok {
+		delete(slf.mapClient, pclient.clientid)
+		//关闭写管道，与SendMsg共用同一把锁，避免向已关闭的channel写入
+		close(pclient.bwritemsg)
+	}
 	slf.locker.Unlock()
-	//关闭写管道
-	close(pclient.bwritemsg)
+}
+
+// ActiveClients 返回当前仍然在线的连接数
+func (slf *WebsocketServer) ActiveClients() int {
+	slf.locker.Lock()
+	defer slf.locker.Unlock()
+	return len(slf.mapClient)
+}
+
+// ClientAddr 返回指定连接的远端地址，连接不存在时返回nil
+func (slf *WebsocketServer) ClientAddr(id uint64) net.Addr {
+	slf.locker.Lock()
+	defer slf.locker.Unlock()
+	pclient, ok := slf.mapClient[id]
+	if ok == false {
+		return nil
+	}
+	return pclient.conn.RemoteAddr()
 }
 
 func (slf *WebsocketServer) SetupReciver(pattern string, messageReciver IMessageReceiver, bEnableCompression bool) {
-	messageReciver.initReciver(messageReciver, slf)
+	reciver := &Reciver{
+		messageReciver:     messageReciver,
+		bEnableCompression: bEnableCompression,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			EnableCompression: bEnableCompression,
+		},
+	}
 
 	if slf.reciver == nil {
-		slf.reciver = make(map[string]Reciver)
+		slf.reciver = make(map[string]*Reciver)
 	}
-	slf.reciver[pattern] = Reciver{messageReciver, bEnableCompression}
+	slf.reciver[pattern] = reciver
+
+	messageReciver.initReciver(messageReciver, slf, reciver)
+}
+
+// SetUpgraderOptions 定制指定pattern下websocket.Upgrader的握手参数，需在SetupReciver之后调用
+func (slf *WebsocketServer) SetUpgraderOptions(pattern string, opts UpgraderOptions) bool {
+	reciver, ok := slf.reciver[pattern]
+	if ok == false {
+		return false
+	}
+
+	if opts.ReadBufferSize > 0 {
+		reciver.upgrader.ReadBufferSize = opts.ReadBufferSize
+	}
+	if opts.WriteBufferSize > 0 {
+		reciver.upgrader.WriteBufferSize = opts.WriteBufferSize
+	}
+	reciver.upgrader.HandshakeTimeout = opts.HandshakeTimeout
+	reciver.upgrader.CheckOrigin = opts.CheckOrigin
+	reciver.upgrader.Subprotocols = opts.Subprotocols
+	if opts.CompressionLevel != nil {
+		reciver.compressionLevel = opts.CompressionLevel
+	}
+
+	return true
 }
 
 func (slf *WebsocketServer) startListen() {
@@ -123,23 +216,37 @@ func (slf *WebsocketServer) startListen() {
 		err = slf.httpserver.ListenAndServe()
 	}
 
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		service.GetLogger().Printf(sysmodule.LEVER_FATAL, "http.ListenAndServe(%d, nil) error:%v\n", slf.port, err)
 		os.Exit(1)
 	}
 }
 
 func (slf *WSClient) startSendMsg() {
+	defer slf.server.wg.Done()
+
+	pingTicker := time.NewTicker(slf.server.PingPeriod)
+	defer pingTicker.Stop()
+
 	for {
-		msgbuf, ok := <-slf.bwritemsg
-		if ok == false {
-			break
-		}
+		select {
+		case msgbuf, ok := <-slf.bwritemsg:
+			if ok == false {
+				return
+			}
 
-		err := slf.conn.WriteMessage(msgbuf.msgtype, msgbuf.bwritemsg)
-		if err != nil {
-			service.GetLogger().Printf(sysmodule.LEVER_INFO, "write client id %d is error :%v\n", slf.clientid, err)
-			break
+			slf.conn.SetWriteDeadline(time.Now().Add(slf.server.WriteWait))
+			err := slf.conn.WriteMessage(msgbuf.msgtype, msgbuf.bwritemsg)
+			if err != nil {
+				service.GetLogger().Printf(sysmodule.LEVER_INFO, "write client id %d is error :%v\n", slf.clientid, err)
+				return
+			}
+		case <-pingTicker.C:
+			slf.conn.SetWriteDeadline(time.Now().Add(slf.server.WriteWait))
+			if err := slf.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				service.GetLogger().Printf(sysmodule.LEVER_INFO, "ping client id %d is error :%v\n", slf.clientid, err)
+				return
+			}
 		}
 	}
 }
@@ -157,9 +264,14 @@ func (slf *WebsocketServer) SendMsg(clientid uint64, messageType int, msg []byte
 		return false
 	}
 
-	value.bwritemsg <- WSMessage{messageType, msg}
-
-	return true
+	//bwritemsg写满或客户端写协程已卡死时不能阻塞在这里，否则会一直占着slf.locker，
+	//连带把Stop()等待这把锁的逻辑也拖死，变成无视ctx超时的死锁
+	select {
+	case value.bwritemsg <- WSMessage{messageType, msg}:
+		return true
+	default:
+		return false
+	}
 }
 
 func (slf *WebsocketServer) Disconnect(clientid uint64) {
@@ -173,10 +285,55 @@ func (slf *WebsocketServer) Disconnect(clientid uint64) {
 	value.conn.Close()
 }
 
-func (slf *WebsocketServer) Stop() {
+// Stop 优雅关闭：先停止监听新连接，再向所有在线连接下发关闭帧，
+// 最后等待所有收发协程退出或ctx超时
+func (slf *WebsocketServer) Stop(ctx context.Context) error {
+	var shutdownErr error
+	if slf.httpserver != nil {
+		shutdownErr = slf.httpserver.Shutdown(ctx)
+	}
+
+	deadline := time.Now().Add(slf.closeDeadline)
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+
+	slf.locker.Lock()
+	clients := make([]*WSClient, 0, len(slf.mapClient))
+	for _, pclient := range slf.mapClient {
+		clients = append(clients, pclient)
+	}
+	slf.locker.Unlock()
+
+	for _, pclient := range clients {
+		pclient.conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+	}
+
+	waitDone := make(chan struct{})
+	go func() {
+		slf.wg.Wait()
+		close(waitDone)
+	}()
+
+	select {
+	case <-waitDone:
+	case <-ctx.Done():
+		if shutdownErr == nil {
+			shutdownErr = ctx.Err()
+		}
+	}
+
+	return shutdownErr
 }
 
 func (slf *BaseMessageReciver) startReadMsg(pclient *WSClient) {
+	defer pclient.server.wg.Done()
+
+	pclient.conn.SetReadLimit(pclient.server.MaxMessageSize)
+	pclient.conn.SetReadDeadline(time.Now().Add(pclient.server.PongWait))
+	pclient.conn.SetPongHandler(func(string) error {
+		pclient.conn.SetReadDeadline(time.Now().Add(pclient.server.PongWait))
+		return nil
+	})
+
 	defer func() {
 		if r := recover(); r != nil {
 			var coreInfo string
@@ -207,9 +364,10 @@ func (slf *BaseMessageReciver) startReadMsg(pclient *WSClient) {
 	}
 }
 
-func (slf *BaseMessageReciver) initReciver(messageReciver IMessageReceiver, websocketServer IWebsocketServer) {
+func (slf *BaseMessageReciver) initReciver(messageReciver IMessageReceiver, websocketServer IWebsocketServer, reciver *Reciver) {
 	slf.messageReciver = messageReciver
 	slf.WsServer = websocketServer
+	slf.reciver = reciver
 }
 
 func (slf *BaseMessageReciver) OnConnected(clientid uint64) {
@@ -222,12 +380,19 @@ func (slf *BaseMessageReciver) OnRecvMsg(clientid uint64, msgtype int, data []by
 }
 
 func (slf *BaseMessageReciver) OnHandleHttp(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
+	conn, err := slf.reciver.upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
 		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
 		return
 	}
 
+	if slf.reciver.bEnableCompression {
+		conn.EnableWriteCompression(true)
+		if slf.reciver.compressionLevel != nil {
+			conn.SetCompressionLevel(*slf.reciver.compressionLevel)
+		}
+	}
+
 	pclient := slf.WsServer.CreateClient(conn)
 	slf.messageReciver.OnConnected(pclient.clientid)
 	go pclient.startSendMsg()
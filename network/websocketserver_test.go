@@ -0,0 +1,117 @@
+package network
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type echoReciver struct {
+	BaseMessageReciver
+}
+
+func (slf *echoReciver) OnRecvMsg(clientid uint64, msgtype int, data []byte) {
+	slf.WsServer.SendMsg(clientid, msgtype, data)
+}
+
+// TestSendMsgConcurrentWithStop 让一个已连接的客户端在持续SendMsg的同时调用Stop，
+// 用于覆盖ReleaseClient/SendMsg共用锁避免向已关闭channel写入的场景，需要配合-race运行
+func TestSendMsgConcurrentWithStop(t *testing.T) {
+	srv := &WebsocketServer{}
+	srv.Init(0)
+
+	reciver := &echoReciver{}
+	srv.SetupReciver("/ws", reciver, false)
+
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reciver.OnHandleHttp(w, r)
+	}))
+	defer httpSrv.Close()
+	srv.httpserver = &http.Server{}
+
+	wsUrl := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if srv.ActiveClients() != 1 {
+		t.Fatalf("expected 1 active client, got %d", srv.ActiveClients())
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.SendMsg(1, websocket.TextMessage, []byte("ping"))
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+// TestStopDoesNotDeadlockOnFullClient 复现一个写协程已经卡死(channel写满)的客户端，
+// 确认SendMsg不会阻塞着slf.locker不放，否则Stop会无视ctx一直等这把锁
+func TestStopDoesNotDeadlockOnFullClient(t *testing.T) {
+	srv := &WebsocketServer{}
+	srv.Init(0)
+
+	pclient := &WSClient{clientid: 1, bwritemsg: make(chan WSMessage, 1024), server: srv}
+	srv.mapClient[1] = pclient
+	for i := 0; i < cap(pclient.bwritemsg); i++ {
+		pclient.bwritemsg <- WSMessage{websocket.TextMessage, []byte("x")}
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- srv.SendMsg(1, websocket.TextMessage, []byte("overflow"))
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expected SendMsg to report failure on a full channel, got true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendMsg blocked instead of failing fast on a full channel")
+	}
+
+	//SendMsg本身已经验证过不会卡住，这里只关心Stop还能不能及时拿到slf.locker
+	delete(srv.mapClient, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := srv.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+}